@@ -28,7 +28,19 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"time"
+)
+
+// Protocol identifies how a Peer relays a CONNECT-style request to the
+// next hop in the chain.
+type Protocol int
+
+const (
+	// ProtocolHTTPConnect issues a plain HTTP CONNECT request (the
+	// default, and the only protocol this package used to support).
+	ProtocolHTTPConnect Protocol = iota
+	// ProtocolSOCKS5 performs a SOCKS5 handshake (RFC 1928), including
+	// optional username/password authentication (RFC 1929).
+	ProtocolSOCKS5
 )
 
 // Peer is a server we are connecting to. This can either be an
@@ -38,7 +50,26 @@ type Peer struct {
 	TLSConfig    *tls.Config         // nil if unencrypted, valid config otherwise
 	HostName     string              // The hostname to connect to
 	Port         int                 // The port to connect to on the hostname
-	ConnectExtra map[string][]string // Extra headers to send after the CONNECT line
+	Protocol     Protocol            // How to relay CONNECT through this peer (defaults to ProtocolHTTPConnect)
+	ConnectExtra map[string][]string // Extra headers (or, for ProtocolSOCKS5, "Username"/"Password") to send after the CONNECT line
+
+	// FallbackTLSPort, if non-zero, makes DialProxyInternal race a plain
+	// TCP dial to this peer against a TLS dial to this port on the same
+	// host, and keep whichever completes the CONNECT to the next peer
+	// first. Only meaningful on the first peer in a chain. This is for
+	// middleboxes that let a CONNECT through on the plain port only to
+	// hang on it, while the same destination wrapped in TLS works fine.
+	FallbackTLSPort int
+
+	// SendProxyProtocol, if not ProxyProtocolNone, makes DialProxyInternal
+	// emit a HAProxy PROXY protocol header as the very first bytes sent
+	// to this peer, before any TLS handshake or HTTP CONNECT, so the
+	// peer can learn the real client address. Only meaningful on the
+	// first peer in a chain, and only takes effect when a source address
+	// is actually available (see DialProxyInternal). No header is sent
+	// when FallbackTLSPort is also set: the racing fallback dial does not
+	// write one.
+	SendProxyProtocol ProxyProtocolVersion
 }
 
 // copyAndClose copies bytes from src to dst and closes both afterwards
@@ -94,76 +125,75 @@ func doHTTPConnect(connection net.Conn, peer Peer, activePeer Peer) (net.Conn, e
 	return &httpConnectResponseConn{connection, res.Body}, nil
 }
 
+// connectToNext performs whatever hop operation peer uses - HTTP CONNECT
+// or SOCKS5 - to reach next over connection.
+func connectToNext(connection net.Conn, peer, next Peer) (net.Conn, error) {
+	switch peer.Protocol {
+	case ProtocolSOCKS5:
+		return doSOCKS5Connect(connection, next, peer)
+	default:
+		return doHTTPConnect(connection, next, peer)
+	}
+}
+
+// maybeWrapTLS wraps connection in a TLS client handshake to peer if
+// peer.TLSConfig is set, and returns connection unchanged otherwise.
+func maybeWrapTLS(connection net.Conn, peer Peer) (net.Conn, error) {
+	if peer.TLSConfig == nil {
+		return connection, nil
+	}
+	tlsConnection := tls.Client(connection, peer.TLSConfig)
+	if err := tlsConnection.Handshake(); err != nil {
+		return connection, fmt.Errorf("handshake with %s failed: %s", peer.HostName, err)
+	}
+	return tlsConnection, nil
+}
+
 // DialProxyInternal dials a proxy using the given slice of peers. It returns a
 // network connection and error. Even if an error is returned, there may
 // be a network connection that needs to be closed.
-func DialProxyInternal(peers []Peer) (net.Conn, error) {
+//
+// source, if not nil, is the address of the real client this dial is being
+// made on behalf of. It is only used if peers[0].SendProxyProtocol is set,
+// in which case it is sent as the very first bytes on the connection to
+// peers[0]; pass nil when there is no such peer, or no real client (for
+// example a pool warming up connections ahead of time). When
+// peers[0].FallbackTLSPort is also set, the first hop is dialled by
+// dialFirstHopWithFallback and no PROXY header is sent.
+func DialProxyInternal(peers []Peer, source net.Addr) (net.Conn, error) {
 	var connection net.Conn
 	var err error
-	for i, peer := range peers {
+
+	start := 0
+	if len(peers) > 1 && peers[0].FallbackTLSPort != 0 {
+		connection, err = dialFirstHopWithFallback(peers[0], peers[1])
+		if err != nil {
+			return connection, err
+		}
+		if connection, err = maybeWrapTLS(connection, peers[1]); err != nil {
+			return connection, err
+		}
+		start = 2
+	}
+
+	for i := start; i < len(peers); i++ {
+		peer := peers[i]
 		// The first peer has to be dialed, others happen via connect
 		if i == 0 {
 			connection, err = net.Dial("tcp", fmt.Sprintf("%s:%d", peer.HostName, peer.Port))
+			if err == nil && peer.SendProxyProtocol != ProxyProtocolNone && source != nil {
+				err = writeProxyProtocolHeader(connection, peer.SendProxyProtocol, source, connection.RemoteAddr())
+			}
 		} else {
-			connection, err = doHTTPConnect(connection, peer, peers[i-1])
+			connection, err = connectToNext(connection, peers[i-1], peer)
 		}
 		if err != nil {
 			return connection, err
 		}
 
-		if peer.TLSConfig != nil {
-			tlsConnection := tls.Client(connection, peer.TLSConfig)
-			if err := tlsConnection.Handshake(); err != nil {
-				return connection, fmt.Errorf("handshake with %s failed: %s", peer.HostName, err)
-			}
-			connection = tlsConnection
+		if connection, err = maybeWrapTLS(connection, peer); err != nil {
+			return connection, err
 		}
 	}
 	return connection, nil
 }
-
-type connResult struct {
-	c net.Conn
-	e error
-}
-
-var tcpConnections = make(map[string]chan connResult)
-
-// DialProxy is a buffered version of DialProxyInternal(). It keeps a channel for a given list of peers
-// and generates new connections in a background goroutine, thus removing the overhead for establishing
-// new connections for all except the first one (and occassional timed out ones).
-func DialProxy(peers []Peer) (net.Conn, error) {
-	a := time.Now()
-	peersAsString := ""
-	for _, peer := range peers {
-		peersAsString += fmt.Sprintf("%s:%d/", peer.HostName, peer.Port)
-	}
-	chn, ok := tcpConnections[peersAsString]
-	if !ok {
-		chn = make(chan connResult)
-		tcpConnections[peersAsString] = chn
-
-		go func() {
-			for {
-				a := time.Now()
-				conn, err := DialProxyInternal(peers)
-				log.Printf("Established %s in the background in %s", peersAsString, time.Now().Sub(a))
-				chn <- connResult{conn, err}
-			}
-		}()
-	}
-
-	for {
-		res := <-chn
-		// Discard closed connections
-		if _, err := res.c.Read(make([]byte, 0, 0)); err != nil {
-			log.Printf("Discarding: %s", err)
-			continue
-		}
-		if res.e != nil {
-			return nil, res.e
-		}
-		log.Printf("Fully established %s in %s", peersAsString, time.Now().Sub(a))
-		return res.c, nil
-	}
-}
@@ -0,0 +1,134 @@
+// Cleartext-with-TLS-fallback dialing for the first hop of a peer chain,
+// for middleboxes that let a plain CONNECT through only to hang on it.
+
+package bridgeproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// firstHopResult is the outcome of one racing attempt at dialing and
+// connecting through the first hop of a peer chain.
+type firstHopResult struct {
+	idx  int
+	conn net.Conn
+	err  error
+}
+
+// firstHopSlot holds the raw, not-yet-wrapped connection of one racing
+// attempt, so the other attempt can be aborted by closing it out from
+// under whatever step (TLS handshake, CONNECT) is currently blocked on it,
+// rather than waiting for that step to finish on its own - which, for the
+// plain-CONNECT-hangs-forever case this feature exists for, it never does.
+type firstHopSlot struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// set records conn as this attempt's raw connection, unless the slot was
+// already cancelled, in which case conn is closed immediately and set
+// reports false.
+func (s *firstHopSlot) set(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+// cancel closes the slot's connection, if any has been set yet, and marks
+// the slot so that a connection set afterwards is closed right away too.
+func (s *firstHopSlot) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// fallbackTLSConfig derives the tls.Config used for the TLS-wrapped
+// fallback dial from peer.TLSConfig, so the fallback path is verified the
+// same way the configured primary path would be, rather than with a bare
+// default config. ServerName defaults to the peer's hostname if unset.
+func fallbackTLSConfig(peer Peer) *tls.Config {
+	config := &tls.Config{}
+	if peer.TLSConfig != nil {
+		config = peer.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = peer.HostName
+	}
+	return config
+}
+
+// dialFirstHopWithFallback races a plain TCP dial to peer against a TLS
+// dial to peer.FallbackTLSPort on the same host, each immediately followed
+// by the CONNECT (or SOCKS5 connect) to next, and keeps whichever finishes
+// that handshake first. The loser is cancelled by closing its raw
+// connection as soon as a winner is known - which unblocks it even if it
+// is stuck in a TLS handshake or waiting on a CONNECT reply that will
+// never come - rather than waiting for it to finish on its own.
+func dialFirstHopWithFallback(peer, next Peer) (net.Conn, error) {
+	slots := [2]*firstHopSlot{{}, {}}
+	results := make(chan firstHopResult, 2)
+
+	attempt := func(idx int, rawDial func() (net.Conn, error), wrap func(net.Conn) (net.Conn, error)) {
+		raw, err := rawDial()
+		if err != nil {
+			results <- firstHopResult{idx: idx, err: err}
+			return
+		}
+		if !slots[idx].set(raw) {
+			results <- firstHopResult{idx: idx, err: fmt.Errorf("cancelled")}
+			return
+		}
+
+		conn := raw
+		if wrap != nil {
+			if conn, err = wrap(raw); err != nil {
+				slots[idx].cancel()
+				results <- firstHopResult{idx: idx, err: err}
+				return
+			}
+		}
+
+		connected, err := connectToNext(conn, peer, next)
+		if err != nil {
+			slots[idx].cancel()
+			results <- firstHopResult{idx: idx, err: err}
+			return
+		}
+		results <- firstHopResult{idx: idx, conn: connected}
+	}
+
+	go attempt(0, func() (net.Conn, error) {
+		return net.Dial("tcp", fmt.Sprintf("%s:%d", peer.HostName, peer.Port))
+	}, nil)
+	go attempt(1, func() (net.Conn, error) {
+		return net.Dial("tcp", fmt.Sprintf("%s:%d", peer.HostName, peer.FallbackTLSPort))
+	}, func(raw net.Conn) (net.Conn, error) {
+		tlsConn := tls.Client(raw, fallbackTLSConfig(peer))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	})
+
+	if first := <-results; first.err == nil {
+		slots[1-first.idx].cancel()
+		return first.conn, nil
+	}
+
+	// The first attempt to finish failed - give the other one, which
+	// might just be the slower, unmangled path, a chance to complete.
+	second := <-results
+	return second.conn, second.err
+}
@@ -7,25 +7,67 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 )
 
 // httpProxyHandler implements a http.Handler for proxying requests
 type httpProxyHandler struct {
-	client http.Client
-	peers  []Peer
+	client       http.Client
+	peers        []Peer
+	interceptors []Interceptor
+}
+
+// remoteAddrOf parses the host:port string from a http.Request's
+// RemoteAddr into a net.Addr, for use as a PROXY protocol source address.
+// It returns nil if addr cannot be parsed as such.
+func remoteAddrOf(addr string) net.Addr {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	return tcpAddr
+}
+
+// connectTargetOf parses the host:port a CONNECT request names, from r.Host,
+// into a Peer suitable for passing to connectToNext as the destination.
+func connectTargetOf(r *http.Request) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid CONNECT target %q: %s", r.Host, err.Error())
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid CONNECT target %q: %s", r.Host, err.Error())
+	}
+	return Peer{HostName: host, Port: port}, nil
 }
 
 // serveHTTPConnect serves proxy requests for the CONNECT method. It does not
 // print errors, but rather returns them for your proxy handler to handle.
 func (proxy *httpProxyHandler) serveHTTPConnect(w http.ResponseWriter, r *http.Request) error {
 	log.Println("Dialing for CONNECT to", r.URL)
-	remote, err := DialProxy(proxy.peers)
+	remote, err := DialProxy(proxy.peers, remoteAddrOf(r.RemoteAddr))
 	if err != nil {
+		if remote != nil {
+			remote.Close()
+		}
 		return err
 	}
 
-	if err = r.WriteProxy(remote); err != nil {
+	dest, err := connectTargetOf(r)
+	if err != nil {
+		remote.Close()
+		return err
+	}
+
+	// The final hop is dispatched through connectToNext, like every other
+	// hop in the chain, so it honours the last peer's Protocol (HTTP
+	// CONNECT or SOCKS5) and carries its ConnectExtra (e.g. upstream proxy
+	// credentials) - interceptors don't run on CONNECT, so this is the only
+	// place those credentials get attached to it.
+	if remote, err = connectToNext(remote, proxy.peers[len(proxy.peers)-1], dest); err != nil {
+		remote.Close()
 		return err
 	}
 
@@ -34,6 +76,12 @@ func (proxy *httpProxyHandler) serveHTTPConnect(w http.ResponseWriter, r *http.R
 		return err
 	}
 
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		remote.Close()
+		return err
+	}
+
 	go copyAndClose(conn, remote)
 	copyAndClose(remote, conn)
 	return nil
@@ -41,16 +89,13 @@ func (proxy *httpProxyHandler) serveHTTPConnect(w http.ResponseWriter, r *http.R
 
 // ServeHTTP serves proxy requests
 func (proxy *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// authenticate
-	for k, vs := range proxy.peers[len(proxy.peers)-1].ConnectExtra {
-		for _, v := range vs {
-			r.Header.Add(k, v)
-		}
-	}
 	// net/http.Client does not handle the CONNECT stuff that well below, so
 	// let us go a more direct route here - this could be used for the other
 	// methods as well, but that would prevent reusing connections to the
-	// proxy.
+	// proxy. CONNECT tunnels are opaque (typically TLS) once established,
+	// so the interceptor pipeline below does not apply to them; the last
+	// peer's ConnectExtra (e.g. upstream proxy credentials) is instead
+	// attached directly to the CONNECT in serveHTTPConnect.
 	if r.Method == "CONNECT" {
 		if err := proxy.serveHTTPConnect(w, r); err != nil {
 			log.Println(err)
@@ -69,11 +114,20 @@ func (proxy *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		r.URL.Host = r.Host
 	}
 	r.RequestURI = ""
-	res, err := proxy.client.Do(r)
-	if err != nil {
-		log.Println("Could not do", r, "-", err)
-		w.WriteHeader(500)
-		return
+
+	req, res := applyOnRequest(proxy.interceptors, r)
+	if res == nil {
+		var err error
+		res, err = proxy.client.Do(req)
+		if err != nil {
+			log.Println("Could not do", req, "-", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	res = applyOnResponse(proxy.interceptors, res)
+	if res.Body == nil {
+		res.Body = http.NoBody
 	}
 
 	for k, vs := range res.Header {
@@ -90,7 +144,12 @@ func (proxy *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 // that proxies HTTP requests via the configured proxies. It supports
 // not only HTTP proxy requests, but also normal HTTP/1.1 requests with a
 // Host header - thus enabling the use as a transparent proxy.
-func HTTPProxyHandler(peers []Peer) http.Handler {
+//
+// The given interceptors, if any, are chained in order and run on every
+// non-CONNECT request and response; see Interceptor. To accept a PROXY
+// protocol header on the inbound connection, wrap your net.Listener with
+// NewProxyProtocolListener before passing it to http.Serve.
+func HTTPProxyHandler(peers []Peer, interceptors ...Interceptor) http.Handler {
 	host := fmt.Sprintf("%s:%d", peers[len(peers)-1].HostName, peers[len(peers)-1].Port)
 	transport := http.Transport{
 		MaxIdleConns:        64,
@@ -106,7 +165,9 @@ func HTTPProxyHandler(peers []Peer) http.Handler {
 				return nil, fmt.Errorf("Target is not the proxy host: %s is not %s", addr, host)
 			}
 			log.Println("Dial called for", addr)
-			c, err := DialProxy(peers)
+			// No per-request context is available here, so a PROXY
+			// protocol peer can't be supported on this path.
+			c, err := DialProxy(peers, nil)
 			if err != nil {
 				if c != nil {
 					c.Close()
@@ -123,5 +184,5 @@ func HTTPProxyHandler(peers []Peer) http.Handler {
 		},
 	}
 
-	return &httpProxyHandler{client, peers}
+	return &httpProxyHandler{client, peers, interceptors}
 }
@@ -0,0 +1,150 @@
+// The Interceptor pipeline lets a caller inspect, rewrite, block, or log
+// the HTTP requests and responses flowing through HTTPProxyHandler or
+// ListenTLSMITM, without those functions having to grow a special case for
+// every use a caller might want.
+
+package bridgeproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Interceptor inspects or rewrites the HTTP requests and responses flowing
+// through a proxy handler or MITM listener. Several Interceptors can be
+// chained in order; see applyOnRequest and applyOnResponse.
+type Interceptor interface {
+	// OnRequest is called with every request before it is sent upstream.
+	// It returns the (possibly rewritten) request to pass to the next
+	// Interceptor in the chain. If it also returns a non-nil response,
+	// the chain stops there and that response is sent back to the
+	// client without ever dialling upstream.
+	OnRequest(*http.Request) (*http.Request, *http.Response)
+	// OnResponse is called with every response, whether it came from
+	// upstream or from an earlier Interceptor short-circuiting the
+	// request. It returns the (possibly rewritten) response to pass to
+	// the next Interceptor in the chain.
+	OnResponse(*http.Response) *http.Response
+}
+
+// applyOnRequest runs req through each Interceptor's OnRequest in order,
+// stopping as soon as one of them returns a short-circuit response.
+func applyOnRequest(interceptors []Interceptor, req *http.Request) (*http.Request, *http.Response) {
+	for _, i := range interceptors {
+		var res *http.Response
+		req, res = i.OnRequest(req)
+		if res != nil {
+			return req, res
+		}
+	}
+	return req, nil
+}
+
+// applyOnResponse runs res through each Interceptor's OnResponse in order.
+func applyOnResponse(interceptors []Interceptor, res *http.Response) *http.Response {
+	for _, i := range interceptors {
+		res = i.OnResponse(res)
+	}
+	return res
+}
+
+// RequestInterceptorFunc adapts a plain function to an Interceptor whose
+// OnResponse passes the response through unchanged, the same way
+// http.HandlerFunc adapts a function to a http.Handler.
+type RequestInterceptorFunc func(*http.Request) (*http.Request, *http.Response)
+
+// OnRequest calls f.
+func (f RequestInterceptorFunc) OnRequest(r *http.Request) (*http.Request, *http.Response) {
+	return f(r)
+}
+
+// OnResponse passes res through unchanged.
+func (f RequestInterceptorFunc) OnResponse(res *http.Response) *http.Response {
+	return res
+}
+
+// ResponseInterceptorFunc adapts a plain function to an Interceptor whose
+// OnRequest passes the request through unchanged.
+type ResponseInterceptorFunc func(*http.Response) *http.Response
+
+// OnRequest passes r through unchanged.
+func (f ResponseInterceptorFunc) OnRequest(r *http.Request) (*http.Request, *http.Response) {
+	return r, nil
+}
+
+// OnResponse calls f.
+func (f ResponseInterceptorFunc) OnResponse(res *http.Response) *http.Response {
+	return f(res)
+}
+
+// HeaderInjector is an Interceptor that adds headers to requests based on
+// the target host, superseding the old behaviour of copying a Peer's
+// ConnectExtra onto every request regardless of where it was going.
+type HeaderInjector struct {
+	// Hosts maps a request's Host to the headers that should be added to
+	// it. A host not present here is left untouched.
+	Hosts map[string]http.Header
+}
+
+// OnRequest adds the headers configured for r.Host, if any.
+func (h HeaderInjector) OnRequest(r *http.Request) (*http.Request, *http.Response) {
+	for k, vs := range h.Hosts[r.Host] {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	return r, nil
+}
+
+// OnResponse passes res through unchanged.
+func (h HeaderInjector) OnResponse(res *http.Response) *http.Response {
+	return res
+}
+
+// RequestLogger is an Interceptor that logs a structured summary of every
+// request/response pair it sees, parsing application/x-www-form-urlencoded
+// bodies so they show up in the log instead of as opaque bytes.
+type RequestLogger struct {
+	// Logger is used for output; the standard logger is used if nil.
+	Logger *log.Logger
+}
+
+func (l RequestLogger) logger() *log.Logger {
+	if l.Logger != nil {
+		return l.Logger
+	}
+	return log.Default()
+}
+
+// OnRequest logs the method, URL, and - for form posts - the parsed body.
+func (l RequestLogger) OnRequest(r *http.Request) (*http.Request, *http.Response) {
+	summary := fmt.Sprintf("%s %s", r.Method, r.URL)
+
+	if r.Body != nil && r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			if form, err := url.ParseQuery(string(body)); err == nil {
+				summary += fmt.Sprintf(" form=%v", form)
+			}
+		}
+	}
+
+	l.logger().Println("request:", summary)
+	return r, nil
+}
+
+// OnResponse logs the request URL alongside the response status code.
+func (l RequestLogger) OnResponse(res *http.Response) *http.Response {
+	if res.Request != nil {
+		l.logger().Printf("response: %s -> %d", res.Request.URL, res.StatusCode)
+	} else {
+		l.logger().Printf("response: %d", res.StatusCode)
+	}
+	return res
+}
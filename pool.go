@@ -0,0 +1,289 @@
+// Pool keeps a warm set of pre-dialled connections per peer chain, so that
+// DialProxy rarely has to pay for a full dial-and-handshake chain on the
+// calling goroutine.
+
+package bridgeproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// poolConn is a connection sitting in a poolChain's idle queue, along with
+// the time it was put there (for IdleTimeout) and any error encountered
+// while dialling it (so dial failures can be handed back to a waiting
+// Get() instead of silently retried forever).
+type poolConn struct {
+	conn      net.Conn
+	err       error
+	idleSince time.Time
+}
+
+// poolChain is the warm-connection state the Pool keeps for one distinct
+// peer chain.
+type poolChain struct {
+	peers []Peer
+	label string
+
+	idle    chan poolConn
+	request chan struct{}
+	stop    chan struct{}
+}
+
+// Pool manages warm connections for one or more peer chains, replacing the
+// single unbuffered goroutine-and-map that DialProxy used to keep
+// internally: that scheme mutated a plain map without a lock, "discarded
+// closed connections" with a zero-length Read that can never observe a
+// half-closed peer, and let one idle connection block the whole chain if
+// nobody consumed it.
+//
+// The zero value of Pool is usable and behaves like DialProxy always did:
+// one warm connection kept ready per peer chain, forever. Use NewPool or
+// set the fields directly for anything else.
+type Pool struct {
+	// MinIdle is the number of concurrent background dialers warming up
+	// connections for each peer chain. Defaults to 1.
+	MinIdle int
+	// MaxIdle is the maximum number of idle, pre-dialled connections the
+	// pool buffers per peer chain before a dialer waits for demand
+	// instead of dialling ahead. Defaults to MinIdle, or 1.
+	MaxIdle int
+	// IdleTimeout is how long a pre-dialled connection may sit in the
+	// pool before Get considers it stale and closes it instead of
+	// handing it out. Zero means connections never go stale this way.
+	IdleTimeout time.Duration
+
+	initOnce sync.Once
+	mu       sync.Mutex
+	chains   map[string]*poolChain
+	done     chan struct{}
+}
+
+// NewPool constructs a Pool with the given MinIdle, MaxIdle, and
+// IdleTimeout.
+func NewPool(minIdle, maxIdle int, idleTimeout time.Duration) *Pool {
+	return &Pool{MinIdle: minIdle, MaxIdle: maxIdle, IdleTimeout: idleTimeout}
+}
+
+// DefaultPool is the Pool used by the package-level DialProxy function.
+var DefaultPool = &Pool{}
+
+// DialProxy is a buffered version of DialProxyInternal(). It keeps a warm
+// connection ready per peer chain in DefaultPool, removing the overhead of
+// establishing new connections for all except the first one (and
+// occasional timed out ones).
+//
+// source is passed to DialProxyInternal and is only used when peers[0]
+// requires a PROXY protocol header; pass nil otherwise.
+func DialProxy(peers []Peer, source net.Addr) (net.Conn, error) {
+	return DefaultPool.Get(peers, source)
+}
+
+func (p *Pool) init() {
+	p.initOnce.Do(func() {
+		p.chains = make(map[string]*poolChain)
+		p.done = make(chan struct{})
+	})
+}
+
+func (p *Pool) minIdle() int {
+	if p.MinIdle > 0 {
+		return p.MinIdle
+	}
+	return 1
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return p.minIdle()
+}
+
+// peerChainFingerprint identifies a peer chain for the purpose of sharing
+// a warm pool between calls with the same chain.
+func peerChainFingerprint(peers []Peer) string {
+	fingerprint := ""
+	for _, peer := range peers {
+		fingerprint += fmt.Sprintf("%d:%s:%d/", peer.Protocol, peer.HostName, peer.Port)
+	}
+	return fingerprint
+}
+
+// chainFor returns the poolChain for peers, creating it (and starting its
+// background dialers) on first use.
+func (p *Pool) chainFor(peers []Peer) *poolChain {
+	p.init()
+
+	key := peerChainFingerprint(peers)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if chain, ok := p.chains[key]; ok {
+		return chain
+	}
+
+	chain := &poolChain{
+		peers:   peers,
+		label:   key,
+		idle:    make(chan poolConn, p.maxIdle()),
+		request: make(chan struct{}, p.maxIdle()),
+		stop:    make(chan struct{}),
+	}
+	p.chains[key] = chain
+
+	for i := 0; i < p.minIdle(); i++ {
+		go p.fill(chain)
+	}
+	return chain
+}
+
+// fill runs in the background, keeping chain.idle topped up to MaxIdle.
+// Once full, it waits for a Get() to signal demand before dialling again.
+func (p *Pool) fill(chain *poolChain) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-chain.stop:
+			return
+		default:
+		}
+
+		if len(chain.idle) >= p.maxIdle() {
+			select {
+			case <-chain.request:
+			case <-p.done:
+				return
+			case <-chain.stop:
+				return
+			}
+			continue
+		}
+
+		start := time.Now()
+		conn, err := DialProxyInternal(chain.peers, nil)
+		if err == nil {
+			log.Printf("Established %s in the background in %s", chain.label, time.Since(start))
+		}
+
+		select {
+		case chain.idle <- poolConn{conn: conn, err: err, idleSince: time.Now()}:
+		case <-p.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		case <-chain.stop:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// Get returns a connection for the given peer chain, handing out a warm,
+// live connection from the pool when one is available.
+//
+// source is the real client this connection is being dialled on behalf
+// of; it is only used when peers[0] requires a PROXY protocol header, in
+// which case that necessarily client-specific requirement makes the chain
+// unpoolable and Get dials fresh every time instead. Pass nil otherwise.
+func (p *Pool) Get(peers []Peer, source net.Addr) (net.Conn, error) {
+	if len(peers) > 0 && peers[0].SendProxyProtocol != ProxyProtocolNone {
+		return DialProxyInternal(peers, source)
+	}
+
+	chain := p.chainFor(peers)
+
+	for {
+		pc := <-chain.idle
+		select {
+		case chain.request <- struct{}{}:
+		default:
+		}
+
+		if pc.err != nil {
+			if pc.conn != nil {
+				pc.conn.Close()
+			}
+			return nil, pc.err
+		}
+		if !isLive(pc.conn) {
+			log.Printf("Discarding dead connection for %s", chain.label)
+			pc.conn.Close()
+			continue
+		}
+		if p.IdleTimeout > 0 && time.Since(pc.idleSince) > p.IdleTimeout {
+			log.Printf("Discarding idle connection for %s: idle for too long", chain.label)
+			pc.conn.Close()
+			continue
+		}
+		return pc.conn, nil
+	}
+}
+
+// Close stops every background dialer and closes any connection currently
+// sitting idle in the pool. It is safe to call more than once.
+func (p *Pool) Close() error {
+	p.init()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+
+	for _, chain := range p.chains {
+		close(chain.stop)
+		drainIdle(chain)
+	}
+	p.chains = make(map[string]*poolChain)
+	return nil
+}
+
+// drainIdle closes every connection currently buffered in chain.idle.
+func drainIdle(chain *poolChain) {
+	for {
+		select {
+		case pc := <-chain.idle:
+			if pc.conn != nil {
+				pc.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// isLive makes a best-effort check that conn is still usable: it arms a
+// short read deadline and tries to peek a byte. A healthy, genuinely idle
+// connection has nothing to read and times out; a closed or half-closed
+// one fails or returns EOF immediately.
+func isLive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if err == nil {
+		// Data arrived before we ever wrote anything to this
+		// connection - whoever gets it next can't make sense of
+		// protocol state at this point, so treat it as unusable.
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+// Support for the HAProxy PROXY protocol (v1 and v2), which lets a proxy
+// chain carry the real client address across a hop that would otherwise
+// hide it, by sending it as a short header before any other bytes.
+
+package bridgeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ProxyProtocolVersion selects whether, and which version of, a PROXY
+// protocol header a Peer emits on connect.
+type ProxyProtocolVersion int
+
+const (
+	// ProxyProtocolNone sends no PROXY protocol header (the default).
+	ProxyProtocolNone ProxyProtocolVersion = iota
+	// ProxyProtocolV1 sends the human-readable text header.
+	ProxyProtocolV1
+	// ProxyProtocolV2 sends the compact binary header.
+	ProxyProtocolV2
+)
+
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyProtocolHeader writes a v1 or v2 PROXY protocol header to
+// connection, describing a connection from source to destination. It must
+// be the very first thing written to connection.
+func writeProxyProtocolHeader(connection net.Conn, version ProxyProtocolVersion, source, destination net.Addr) error {
+	srcHost, srcPort, err := splitHostPort(source)
+	if err != nil {
+		return fmt.Errorf("proxy protocol source address: %s", err.Error())
+	}
+	dstHost, dstPort, err := splitHostPort(destination)
+	if err != nil {
+		return fmt.Errorf("proxy protocol destination address: %s", err.Error())
+	}
+
+	family := "TCP4"
+	if srcHost.To4() == nil {
+		family = "TCP6"
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		header := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcHost, dstHost, srcPort, dstPort)
+		_, err := connection.Write([]byte(header))
+		return err
+	case ProxyProtocolV2:
+		return writeProxyProtocolV2Header(connection, srcHost, dstHost, srcPort, dstPort)
+	default:
+		return nil
+	}
+}
+
+// writeProxyProtocolV2Header writes the binary v2 header described in the
+// PROXY protocol specification, for a TCP4 or TCP6 connection.
+func writeProxyProtocolV2Header(connection net.Conn, srcHost, dstHost net.IP, srcPort, dstPort int) error {
+	var addrFamily byte = 0x11 // AF_INET, STREAM
+	addrLen := net.IPv4len
+	if srcHost.To4() == nil {
+		addrFamily = 0x21 // AF_INET6, STREAM
+		addrLen = net.IPv6len
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(addrFamily)
+	binary.Write(&buf, binary.BigEndian, uint16(2*addrLen+4))
+
+	if addrLen == net.IPv4len {
+		buf.Write(srcHost.To4())
+		buf.Write(dstHost.To4())
+	} else {
+		buf.Write(srcHost.To16())
+		buf.Write(dstHost.To16())
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+	binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+
+	_, err := connection.Write(buf.Bytes())
+	return err
+}
+
+// splitHostPort extracts an IP and port from addr, which is expected to be
+// a *net.TCPAddr (as returned by net.Dial("tcp", ...) and friends).
+func splitHostPort(addr net.Addr) (net.IP, int, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, 0, fmt.Errorf("%s is not a TCP address", addr)
+	}
+	return tcpAddr.IP, tcpAddr.Port, nil
+}
+
+// proxyProtocolConn overrides RemoteAddr() to return the address carried
+// in a PROXY protocol header that has already been stripped from the
+// stream.
+type proxyProtocolConn struct {
+	net.Conn
+	*bufio.Reader
+	remoteAddr net.Addr
+}
+
+// Read reads from the buffered reader, not the raw connection, so that
+// any bytes read while peeking for the PROXY header are not lost.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// RemoteAddr returns the real client address carried in the PROXY
+// protocol header, rather than the address of whatever sent it (typically
+// a load balancer).
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// NewProxyProtocolListener wraps ln so that every connection it accepts is
+// expected to begin with a v1 or v2 PROXY protocol header; that header is
+// stripped, and the returned connections' RemoteAddr() reports the real
+// client address it carried instead of the address of whoever sent it.
+func NewProxyProtocolListener(ln net.Listener) net.Listener {
+	return &proxyProtocolListener{ln}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	stripped, err := stripProxyProtocolHeader(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading proxy protocol header: %s", err.Error())
+	}
+	return stripped, nil
+}
+
+// stripProxyProtocolHeader peeks at the start of conn, parses a v1 or v2
+// PROXY protocol header from it, and returns a connection with the header
+// consumed and RemoteAddr() overridden to the address it carried.
+func stripProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		remoteAddr, err := readProxyProtocolV2Header(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyProtocolConn{conn, reader, remoteAddr}, nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	remoteAddr, err := parseProxyProtocolV1Header(line)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{conn, reader, remoteAddr}, nil
+}
+
+// parseProxyProtocolV1Header parses a "PROXY TCP4 src dst sport dport\r\n"
+// line into a *net.TCPAddr for the source.
+func parseProxyProtocolV1Header(line string) (net.Addr, error) {
+	var proto, src, dst string
+	var srcPort, dstPort int
+	n, err := fmt.Sscanf(line, "PROXY %s %s %s %d %d", &proto, &src, &dst, &srcPort, &dstPort)
+	if err != nil || n != 5 {
+		return nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: net.ParseIP(src), Port: srcPort}, nil
+}
+
+// readProxyProtocolV2Header reads and parses a binary v2 header, already
+// known to start with the v2 signature, from reader.
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	addrFamily := header[len(proxyProtocolV2Signature)+1]
+	addrLen := binary.BigEndian.Uint16(header[len(proxyProtocolV2Signature)+2:])
+
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	switch addrFamily {
+	case 0x11: // AF_INET
+		if addrLen < 12 {
+			return nil, fmt.Errorf("proxy protocol v2 TCP4 address too short: %d bytes", addrLen)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // AF_INET6
+		if addrLen < 36 {
+			return nil, fmt.Errorf("proxy protocol v2 TCP6 address too short: %d bytes", addrLen)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol v2 address family %#x", addrFamily)
+	}
+}
@@ -0,0 +1,126 @@
+// Functions for relaying CONNECT-style requests through a SOCKS5 peer.
+
+package bridgeproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// doSOCKS5Connect issues a SOCKS5 CONNECT request on a connection, per
+// RFC 1928, including the username/password sub-negotiation of RFC 1929
+// if the SOCKS5 server requires it. It always returns a connection, but
+// may also return an error.
+//
+// The parameter peer describes the peer we want to connect to.
+// The parameter activePeer is the SOCKS5 server we are currently talking
+// to; its ConnectExtra may carry "Username"/"Password" for RFC 1929 auth.
+func doSOCKS5Connect(connection net.Conn, peer Peer, activePeer Peer) (net.Conn, error) {
+	username := firstOrEmpty(activePeer.ConnectExtra["Username"])
+	password := firstOrEmpty(activePeer.ConnectExtra["Password"])
+
+	methods := []byte{0x00} // no authentication required
+	if username != "" {
+		methods = []byte{0x02} // username/password
+	}
+
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := connection.Write(greeting); err != nil {
+		return connection, fmt.Errorf("socks5 greeting to %s: %s", peer.HostName, err.Error())
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(connection, reply); err != nil {
+		return connection, fmt.Errorf("socks5 greeting reply from %s: %s", peer.HostName, err.Error())
+	}
+	if reply[0] != 0x05 {
+		return connection, fmt.Errorf("socks5 greeting reply from %s: unexpected version %d", peer.HostName, reply[0])
+	}
+
+	switch reply[1] {
+	case 0x00:
+		// No authentication required.
+	case 0x02:
+		if err := doSOCKS5UserPassAuth(connection, username, password); err != nil {
+			return connection, fmt.Errorf("socks5 auth with %s: %s", peer.HostName, err.Error())
+		}
+	default:
+		return connection, fmt.Errorf("socks5 server %s offered no acceptable authentication method", peer.HostName)
+	}
+
+	host := []byte(peer.HostName)
+	req := make([]byte, 0, 7+len(host))
+	req = append(req, 0x05, 0x01, 0x00, 0x03, byte(len(host)))
+	req = append(req, host...)
+	req = append(req, byte(peer.Port>>8), byte(peer.Port))
+	if _, err := connection.Write(req); err != nil {
+		return connection, fmt.Errorf("socks5 connect to %s: %s", peer.HostName, err.Error())
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(connection, header); err != nil {
+		return connection, fmt.Errorf("socks5 connect reply from %s: %s", peer.HostName, err.Error())
+	}
+	if header[1] != 0x00 {
+		return connection, fmt.Errorf("socks5 connect to %s failed with code %d", peer.HostName, header[1])
+	}
+
+	if err := discardSOCKS5BoundAddress(connection, header[3]); err != nil {
+		return connection, fmt.Errorf("socks5 connect reply from %s: %s", peer.HostName, err.Error())
+	}
+
+	return connection, nil
+}
+
+// doSOCKS5UserPassAuth performs the username/password sub-negotiation
+// described in RFC 1929.
+func doSOCKS5UserPassAuth(connection net.Conn, username, password string) error {
+	req := make([]byte, 0, 3+len(username)+len(password))
+	req = append(req, 0x01, byte(len(username)))
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := connection.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(connection, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("authentication failed with code %d", reply[1])
+	}
+	return nil
+}
+
+// discardSOCKS5BoundAddress reads and discards the BND.ADDR/BND.PORT
+// fields of a SOCKS5 reply, whose length depends on the address type atyp.
+func discardSOCKS5BoundAddress(connection net.Conn, atyp byte) error {
+	var addrLen int
+	switch atyp {
+	case 0x01: // IPv4
+		addrLen = net.IPv4len
+	case 0x04: // IPv6
+		addrLen = net.IPv6len
+	case 0x03: // Domain name, length-prefixed
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(connection, lengthByte); err != nil {
+			return err
+		}
+		addrLen = int(lengthByte[0])
+	default:
+		return fmt.Errorf("unknown address type %d", atyp)
+	}
+	_, err := io.ReadFull(connection, make([]byte, addrLen+2)) // address, then port
+	return err
+}
+
+// firstOrEmpty returns the first element of values, or "" if it is empty.
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
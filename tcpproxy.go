@@ -24,8 +24,8 @@ func writeHTTPResponse(w io.Writer, code int, format string, printf ...interface
 }
 
 // handleRequest handles a request by calling dialProxy() and then forwarding
-func handleRequest(client io.ReadWriteCloser, peers []Peer) {
-	remote, err := DialProxy(peers)
+func handleRequest(client net.Conn, peers []Peer) {
+	remote, err := DialProxy(peers, client.RemoteAddr())
 	if err != nil {
 		log.Println("Error:", strings.TrimSpace(err.Error()))
 		writeHTTPResponse(client, 502, "Error: %s", err.Error())
@@ -42,14 +42,19 @@ func handleRequest(client io.ReadWriteCloser, peers []Peer) {
 
 // Serve serves the specified configuration, forwarding any packets from the
 // local address given in listenAdress to the last peer specified in peers via
-// any peers before specified before it.
-func Serve(listenAdress string, peers []Peer) {
+// any peers before specified before it. If acceptProxyProtocol is true, every
+// accepted connection is expected to begin with a PROXY protocol header,
+// which is stripped and used as the connection's real client address.
+func Serve(listenAdress string, peers []Peer, acceptProxyProtocol bool) {
 	// Listen for incoming connections.
 	l, err := net.Listen("tcp", listenAdress)
 	if err != nil {
 		log.Println("Error listening:", err.Error())
 		os.Exit(1)
 	}
+	if acceptProxyProtocol {
+		l = NewProxyProtocolListener(l)
+	}
 	// Close the listener when the application closes.
 	defer l.Close()
 	log.Println("Listening on", listenAdress)
@@ -0,0 +1,249 @@
+// Functions for terminating client TLS locally and inspecting the
+// decrypted HTTP traffic, instead of just splicing opaque bytes end to end
+// as ListenTLS does.
+
+package bridgeproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// mitmCertCacheSize bounds the number of minted leaf certificates kept
+// around per ListenTLSMITM listener.
+const mitmCertCacheSize = 1024
+
+// mitmCertCache is a bounded, mutex-protected LRU cache of leaf
+// certificates minted on demand for a MITM TLS listener, keyed by the
+// client's SNI hostname.
+type mitmCertCache struct {
+	mu      sync.Mutex
+	ca      tls.Certificate
+	caLeaf  *x509.Certificate
+	max     int
+	order   []string
+	entries map[string]*tls.Certificate
+}
+
+// newMITMCertCache prepares a cert cache that mints leaves signed by ca,
+// keeping at most max of them alive at a time.
+func newMITMCertCache(ca tls.Certificate, max int) (*mitmCertCache, error) {
+	leaf := ca.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing CA certificate: %s", err.Error())
+		}
+	}
+	return &mitmCertCache{
+		ca:      ca,
+		caLeaf:  leaf,
+		max:     max,
+		entries: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certFor returns a leaf certificate for host, minting and caching a new
+// one signed by the CA if none is cached yet.
+func (c *mitmCertCache) certFor(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cert, ok := c.entries[host]; ok {
+		c.touch(host)
+		return cert, nil
+	}
+
+	cert, err := mintLeafCert(host, c.ca, c.caLeaf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[host] = cert
+	c.touch(host)
+	if len(c.order) > c.max {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+	return cert, nil
+}
+
+// touch marks host as the most recently used entry, for LRU eviction.
+func (c *mitmCertCache) touch(host string) {
+	for i, h := range c.order {
+		if h == host {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, host)
+}
+
+// mintLeafCert mints a new leaf certificate for host, signed by ca, copying
+// the hostname into the SAN appropriate for it (DNS name or IP address).
+func mintLeafCert(host string, ca tls.Certificate, caLeaf *x509.Certificate) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key for %s: %s", host, err.Error())
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial for %s: %s", host, err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caLeaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate for %s: %s", host, err.Error())
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, caLeaf.Raw},
+		PrivateKey:  key,
+		Leaf:        template,
+	}, nil
+}
+
+// ListenTLSMITM listens on the given address for TLS connections with SNI,
+// terminates the client TLS handshake locally using a leaf certificate
+// minted on demand from ca for the requested host, dials the upstream
+// origin through peers and performs its own TLS handshake to it, and pipes
+// the decrypted HTTP requests and responses through the given
+// interceptors, chained in order; see Interceptor. Unlike ListenTLS, which
+// only splices opaque bytes end to end, this lets a caller inspect,
+// rewrite, or short-circuit the traffic flowing through the chain. If
+// acceptProxyProtocol is true, every accepted connection is expected to
+// begin with a PROXY protocol header, which is stripped and used as the
+// connection's real client address.
+func ListenTLSMITM(laddr string, peers []Peer, ca tls.Certificate, acceptProxyProtocol bool, interceptors ...Interceptor) {
+	cache, err := newMITMCertCache(ca, mitmCertCacheSize)
+	if err != nil {
+		log.Fatalf("Error preparing MITM CA: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		log.Fatalf("Error listening for TLS connections - %v", err)
+	}
+	if acceptProxyProtocol {
+		ln = NewProxyProtocolListener(ln)
+	}
+	log.Printf("MITM-ing TLS: %s via %v", laddr, peers)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Println("Error accepting new connection:", err)
+			continue
+		}
+		go handleMITMConnection(c, peers, cache, interceptors)
+	}
+}
+
+// handleMITMConnection terminates the client TLS handshake on client,
+// dials the origin indicated by SNI through peers, and relays HTTP
+// requests and responses between the two, running them through
+// interceptors along the way.
+func handleMITMConnection(client net.Conn, peers []Peer, cache *mitmCertCache, interceptors []Interceptor) {
+	defer client.Close()
+
+	tlsClient := tls.Server(client, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cache.certFor(hello.ServerName)
+		},
+	})
+	if err := tlsClient.Handshake(); err != nil {
+		log.Println("MITM handshake with client failed:", err)
+		return
+	}
+	host := tlsClient.ConnectionState().ServerName
+	if host == "" {
+		log.Println("Cannot support non-SNI enabled clients")
+		return
+	}
+
+	remote, err := DialProxy(peers, client.RemoteAddr())
+	if err != nil {
+		log.Println("Cannot dial proxy:", err)
+		if remote != nil {
+			remote.Close()
+		}
+		return
+	}
+	remote, err = connectToNext(remote, peers[len(peers)-1], Peer{HostName: host, Port: 443})
+	if err != nil {
+		log.Println("Cannot do final HTTP connect:", err)
+		remote.Close()
+		return
+	}
+
+	tlsRemote := tls.Client(remote, &tls.Config{ServerName: host})
+	if err := tlsRemote.Handshake(); err != nil {
+		log.Println("MITM handshake with", host, "failed:", err)
+		remote.Close()
+		return
+	}
+	defer tlsRemote.Close()
+
+	clientReader := bufio.NewReader(tlsClient)
+	remoteReader := bufio.NewReader(tlsRemote)
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Reading request from client:", err)
+			}
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+
+		req, res := applyOnRequest(interceptors, req)
+		if res == nil {
+			if err := req.Write(tlsRemote); err != nil {
+				log.Println("Forwarding request to", host, ":", err)
+				return
+			}
+
+			res, err = http.ReadResponse(remoteReader, req)
+			if err != nil {
+				log.Println("Reading response from", host, ":", err)
+				return
+			}
+		}
+		res = applyOnResponse(interceptors, res)
+
+		if err := res.Write(tlsClient); err != nil {
+			log.Println("Forwarding response to client:", err)
+			return
+		}
+	}
+}
@@ -28,13 +28,16 @@ func hijackTLSRequest(client net.Conn, peers []Peer) {
 		return
 	}
 
-	proxy, err := DialProxy(peers)
+	proxy, err := DialProxy(peers, tlsClientConn.RemoteAddr())
 	if err != nil {
 		log.Println("Cannot dial proxy:", err)
+		if proxy != nil {
+			proxy.Close()
+		}
 		return
 	}
 
-	proxy, err = doHTTPConnect(proxy, Peer{HostName: tlsClientConn.Host(), Port: 443}, peers[len(peers)-1])
+	proxy, err = connectToNext(proxy, peers[len(peers)-1], Peer{HostName: tlsClientConn.Host(), Port: 443})
 	if err != nil {
 		log.Println("Cannot do final HTTP connect:", err)
 		return
@@ -47,12 +50,17 @@ func hijackTLSRequest(client net.Conn, peers []Peer) {
 
 // ListenTLS listens on the given address for TLS connections with
 // Server Name Indication (SNI) and proxies them via CONNECT through
-// the given peers.
-func ListenTLS(laddr string, peers []Peer) {
+// the given peers. If acceptProxyProtocol is true, every accepted
+// connection is expected to begin with a PROXY protocol header, which is
+// stripped and used as the connection's real client address.
+func ListenTLS(laddr string, peers []Peer, acceptProxyProtocol bool) {
 	ln, err := net.Listen("tcp", laddr)
 	if err != nil {
 		log.Fatalf("Error listening for TLS connections - %v", err)
 	}
+	if acceptProxyProtocol {
+		ln = NewProxyProtocolListener(ln)
+	}
 	var buffer bytes.Buffer
 	for _, peer := range peers {
 		fmt.Fprintf(&buffer, " → %s:%d", peer.HostName, peer.Port)